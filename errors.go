@@ -0,0 +1,14 @@
+package art
+
+import "errors"
+
+// ErrArenaFull is returned by Insert (and by the factory methods it calls)
+// when the tree was built with a MaxCapacity and the write would grow the
+// arena past that budget. The tree is left exactly as it was before the
+// call: nothing is partially written.
+var ErrArenaFull = errors.New("art: arena has reached its max capacity")
+
+// errUnknownNodeKind guards against an artNode.kind that isn't one of
+// Leaf/Node4/Node16/Node48/Node256, which should only happen from memory
+// corruption or a bug in this package.
+var errUnknownNodeKind = errors.New("art: unknown node kind")
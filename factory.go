@@ -2,63 +2,53 @@ package art
 
 import (
 	"math"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
 type nodeFactory interface {
-	newNode4() *artNode
-	newNode16() *artNode
-	newNode48() *artNode
-	newNode256() *artNode
-	newLeaf(key Key, value interface{}) *artNode
+	newNode4() (memdbArenaAddr, *artNode, error)
+	newNode16() (memdbArenaAddr, *artNode, error)
+	newNode48() (memdbArenaAddr, *artNode, error)
+	newNode256() (memdbArenaAddr, *artNode, error)
+	newLeaf(key Key, value interface{}) (memdbArenaAddr, *artNode, error)
 }
 
-// make sure that objFactory implements all methods of nodeFactory interface
-var _ nodeFactory = &objFactory{}
+// make sure that arenaFactory implements all methods of nodeFactory interface
+var _ nodeFactory = &arenaFactory{}
 
-//var factory = newObjFactory()
+// TreeOption configures a tree's arena at construction time, see newTree.
+type TreeOption func(*arenaFactory)
 
-var factory = newArenaFactory()
-
-func newTree() *tree {
-	return &tree{}
-}
-
-type objFactory struct{}
-
-func newObjFactory() nodeFactory {
-	return &objFactory{}
-}
-
-// Simple obj factory implementation
-func (f *objFactory) newNode4() *artNode {
-	return &artNode{kind: Node4, ref: unsafe.Pointer(new(node4))}
-}
-
-func (f *objFactory) newNode16() *artNode {
-	return &artNode{kind: Node16, ref: unsafe.Pointer(&node16{})}
-}
-
-func (f *objFactory) newNode48() *artNode {
-	return &artNode{kind: Node48, ref: unsafe.Pointer(&node48{})}
-}
-
-func (f *objFactory) newNode256() *artNode {
-	return &artNode{kind: Node256, ref: unsafe.Pointer(&node256{})}
+// WithMaxCapacity bounds this tree's backing arena to at most n bytes. When
+// Insert needs a new block that would take the arena past n bytes, it
+// returns ErrArenaFull instead of allocating it. It only affects the tree
+// it's passed to.
+func WithMaxCapacity(n uint64) TreeOption {
+	return func(f *arenaFactory) {
+		f.maxCapacity = n
+	}
 }
 
-func (f *objFactory) newLeaf(key Key, value interface{}) *artNode {
-	clonedKey := make(Key, len(key))
-	copy(clonedKey, key)
-	return &artNode{
-		kind: Leaf,
-		ref:  unsafe.Pointer(&leaf{key: clonedKey, value: value}),
+func newTree(opts ...TreeOption) *tree {
+	f := newArenaFactory()
+	for _, opt := range opts {
+		opt(f)
 	}
+	return &tree{root: nullAddr, factory: f}
 }
 
 type memdbArenaBlock struct {
-	buf    []byte
-	length int
+	buf []byte
+	// length is a high-water offset into buf. alloc reserves space with a
+	// CompareAndSwap so concurrent readers/writers can race to carve out
+	// disjoint byte ranges of the same block without a lock.
+	length atomic.Uint64
+	// idx is this block's position in arenaFactory.blocks, fixed at
+	// creation time so alloc can build a memdbArenaAddr without touching
+	// the blocks slice (and racing its growth) on the hot path.
+	idx uint32
 }
 
 type memdbArenaAddr struct {
@@ -91,76 +81,180 @@ var (
 	nullAddr = memdbArenaAddr{math.MaxUint32, math.MaxUint32}
 )
 
+// arenaFactory backs a single tree's nodes. alloc is safe to call
+// concurrently with itself (see alloc's doc comment), and so are
+// newNode4/16/48/256 while their freelists are empty and nothing frees a
+// node: popFree takes a slot off a non-empty freelist without
+// synchronization, so two concurrent newNodeN calls can then race on it.
+// newLeaf is not on that list - it appends to heapLeaves under leavesMu
+// rather than going through alloc, but that still makes it safe to call
+// concurrently with other newLeaf/newNodeN calls and with a concurrent
+// WriteSnapshot, just via a lock instead of a CAS. The tree-mutation API
+// built on top - Insert, Delete, Stage/Release/Cleanup - is not: it reads
+// and writes node payloads, freelists, and the stage stack without further
+// synchronization, so callers must still serialize those against one
+// another and against any concurrent alloc from another goroutine.
 type arenaFactory struct {
 	blockSize int
 	blocks    []memdbArenaBlock
+	// active points at the block alloc should try first: the one most
+	// recently appended to blocks. Readers load it without taking growMu;
+	// only the goroutine that actually appends a new block touches it.
+	active atomic.Pointer[memdbArenaBlock]
+	// growMu guards the blocks slice header itself, not just the append
+	// path its name suggests: growActive takes it (Lock) to append a new
+	// block, and dataAt takes it (RLock) to index f.blocks[addr.idx] before
+	// returning a byte range out of that block's buf. Without the RLock,
+	// indexing f.blocks while another goroutine's append reallocates its
+	// backing array is a data race on the slice header, not just on block
+	// contents - the same hazard writeSnapshot's full Lock already guards
+	// against. alloc's hot path never takes it: it only ever touches the
+	// active pointer above, not f.blocks itself. Cleanup (stage.go) also
+	// reads/truncates f.blocks without it, which is safe only because the
+	// arenaFactory doc comment already requires the single writer driving
+	// Stage/Release/Cleanup to serialize against any concurrent alloc.
+	growMu sync.RWMutex
 	// the total size of all blocks, also the approximate memory footprint of the arena.
-	capacity uint64
+	capacity atomic.Uint64
+	// stageMu serializes Stage/Release/Cleanup/recordMutation against each
+	// other. It does not make the staging API safe against a concurrent
+	// alloc/Insert/Delete from another goroutine; see the arenaFactory doc
+	// comment above.
+	stageMu sync.Mutex
+	// stages is the stack of open savepoints, see Stage/Release/Cleanup.
+	stages []stageFrame
+	// maxCapacity bounds how large capacity is allowed to grow, in bytes.
+	// Zero means unbounded. See WithMaxCapacity.
+	maxCapacity uint64
+	// freeNode4/16/48/256 hold addresses of slots abandoned by a node grow
+	// or delete, ready to be handed back out by newNodeN before it falls
+	// back to alloc. See freelist.go.
+	freeNode4   []memdbArenaAddr
+	freeNode16  []memdbArenaAddr
+	freeNode48  []memdbArenaAddr
+	freeNode256 []memdbArenaAddr
+	// Reused counts nodes served from a freelist; Allocated counts nodes
+	// that required a fresh arena allocation. Reused / (Reused+Allocated)
+	// is a rough measure of how well churn is being recycled. Both are
+	// atomic because newNodeN is on the lock-free concurrent alloc path.
+	Reused    atomic.Uint64
+	Allocated atomic.Uint64
+	// heapLeaves backs every leaf ever created, see leafSentinelIdx.
+	// leavesMu guards the slice header where newLeaf appends to it and
+	// getLeaf/writeSnapshot/Cleanup read or truncate it, since append can
+	// reallocate the backing array out from under a concurrent reader.
+	// LoadSnapshot fills it on a factory no other goroutine holds yet, and
+	// Stage reads its length, both without taking leavesMu.
+	leavesMu   sync.RWMutex
+	heapLeaves []*leaf
 }
 
 func newArenaFactory() *arenaFactory {
 	return &arenaFactory{
 		blockSize: 0,
 		blocks:    nil,
-		capacity:  0,
 	}
 }
 
-func (f *arenaFactory) enlarge(allocSize, blockSize int) {
-	f.blockSize = blockSize
-	for f.blockSize <= allocSize {
-		f.blockSize <<= 1
-	}
-	// Size will never larger than maxBlockSize.
-	if f.blockSize > maxBlockSize {
-		f.blockSize = maxBlockSize
+// Capacity returns the total size of all arena blocks, in bytes.
+func (f *arenaFactory) Capacity() uint64 {
+	return f.capacity.Load()
+}
+
+// Used returns the number of bytes actually handed out by alloc so far, as
+// opposed to Capacity which also counts the unused tail of each block.
+func (f *arenaFactory) Used() uint64 {
+	f.growMu.RLock()
+	defer f.growMu.RUnlock()
+
+	var used uint64
+	for i := range f.blocks {
+		used += f.blocks[i].length.Load()
 	}
-	f.blocks = append(f.blocks, memdbArenaBlock{
-		buf: make([]byte, f.blockSize),
-	})
-	f.capacity += uint64(f.blockSize)
+	return used
 }
 
-func (f *arenaFactory) alloc(size int) (memdbArenaAddr, []byte) {
+// alloc reserves size bytes and returns their address. The fast path never
+// takes growMu: it loads the active block and races a CompareAndSwap on its
+// length against any other goroutine doing the same. Only once that CAS
+// can't fit size anymore does a goroutine fall through to growActive.
+func (f *arenaFactory) alloc(size int) (memdbArenaAddr, []byte, error) {
 	if size > maxBlockSize {
 		panic("alloc size is larger than max block size")
 	}
 
-	if len(f.blocks) == 0 {
-		f.enlarge(size, initBlockSize)
+	for {
+		blk := f.active.Load()
+		if blk != nil {
+			if offset, data := blk.alloc(size, true); offset != nullBlockOffset {
+				return memdbArenaAddr{blk.idx, offset}, data, nil
+			}
+		}
+		if err := f.growActive(blk, size); err != nil {
+			return nullAddr, nil, err
+		}
+		// Loop back and retry the CAS against the (possibly new) active block.
 	}
+}
 
-	addr, data := f.allocInLastBlock(size, true)
-	if !addr.isNull() {
-		return addr, data
+// growActive appends a new block big enough for allocSize, then publishes it
+// as active. full is the block the caller observed as full; if another
+// goroutine already grew the arena while we were waiting for growMu, we
+// simply return so the caller retries against the now-current active block
+// instead of growing twice.
+func (f *arenaFactory) growActive(full *memdbArenaBlock, allocSize int) error {
+	f.growMu.Lock()
+	defer f.growMu.Unlock()
+
+	if cur := f.active.Load(); cur != full {
+		return nil
 	}
 
-	f.enlarge(size, f.blockSize<<1)
-	return f.allocInLastBlock(size, true)
-}
-
-func (f *arenaFactory) allocInLastBlock(size int, align bool) (memdbArenaAddr, []byte) {
-	idx := len(f.blocks) - 1
-	offset, data := f.blocks[idx].alloc(size, align)
-	if offset == nullBlockOffset {
-		return nullAddr, nil
+	blockSize := f.blockSize
+	if blockSize == 0 {
+		blockSize = initBlockSize
+	} else {
+		blockSize <<= 1
+	}
+	for blockSize <= allocSize {
+		blockSize <<= 1
 	}
-	return memdbArenaAddr{uint32(idx), offset}, data
+	// Size will never larger than maxBlockSize.
+	if blockSize > maxBlockSize {
+		blockSize = maxBlockSize
+	}
+	if f.maxCapacity > 0 && f.capacity.Load()+uint64(blockSize) > f.maxCapacity {
+		return ErrArenaFull
+	}
+
+	f.blockSize = blockSize
+	f.blocks = append(f.blocks, memdbArenaBlock{
+		buf: make([]byte, blockSize),
+		idx: uint32(len(f.blocks)),
+	})
+	f.capacity.Add(uint64(blockSize))
+	f.active.Store(&f.blocks[len(f.blocks)-1])
+	return nil
 }
 
 func (a *memdbArenaBlock) alloc(size int, align bool) (uint32, []byte) {
-	offset := a.length
-	if align {
-		// We must align the allocated address for node
-		// to make runtime.checkptrAlignment happy.
-		offset = (a.length + 7) & alignMask
+	for {
+		cur := a.length.Load()
+		offset := cur
+		if align {
+			// We must align the allocated address for node
+			// to make runtime.checkptrAlignment happy.
+			offset = (cur + 7) & alignMask
+		}
+		newLen := offset + uint64(size)
+		if newLen > uint64(len(a.buf)) {
+			return nullBlockOffset, nil
+		}
+		if a.length.CompareAndSwap(cur, newLen) {
+			return uint32(offset), a.buf[offset : offset+uint64(size)]
+		}
+		// Lost the race to another allocator on this block; retry.
 	}
-	newLen := offset + size
-	if newLen > len(a.buf) {
-		return nullBlockOffset, nil
-	}
-	a.length = newLen
-	return uint32(offset), a.buf[offset : offset+size]
 }
 
 const (
@@ -171,65 +265,116 @@ const (
 	node256Len = artNodeLen + 2072
 )
 
-func (f *arenaFactory) newNode4() *artNode {
-	addr, data := f.alloc(node4Len)
-	if addr.isNull() {
-		panic("addr is null")
-	}
-	anData := data[:artNodeLen]
-	data = data[artNodeLen:]
-	an := (*artNode)(unsafe.Pointer(&anData))
-	n4 := (*node4)(unsafe.Pointer(&data))
-	n4.zeroChild = nil
-	an.kind = Node4
-	an.ref = unsafe.Pointer(n4)
+// newHeader carves the artNode header out of a freshly (or freelist-)
+// obtained node4Len/16Len/48Len/256Len chunk and points its ref at the
+// payload that immediately follows it in the same chunk.
+func newHeader(addr memdbArenaAddr, data []byte, kind uint8) *artNode {
+	an := (*artNode)(unsafe.Pointer(&data[0]))
+	an.kind = kind
+	an.ref = memdbArenaAddr{idx: addr.idx, off: addr.off + artNodeLen}
 	return an
 }
 
-func (f *arenaFactory) newNode16() *artNode {
-	addr, data := f.alloc(node16Len)
-	if addr.isNull() {
-		panic("addr is null")
+func (f *arenaFactory) newNode4() (memdbArenaAddr, *artNode, error) {
+	addr, data, ok := f.popFree(&f.freeNode4, node4Len)
+	if !ok {
+		var err error
+		addr, data, err = f.alloc(node4Len)
+		if err != nil {
+			return nullAddr, nil, err
+		}
+		f.Allocated.Add(1)
 	}
-	anData := data[:artNodeLen]
-	data = data[artNodeLen:]
-	an := (*artNode)(unsafe.Pointer(&anData))
-	an.kind = Node16
-	an.ref = unsafe.Pointer(&data)
-	return an
+	an := newHeader(addr, data, Node4)
+	initNode4(f.getNode4(an))
+	return addr, an, nil
 }
 
-func (f *arenaFactory) newNode48() *artNode {
-	addr, data := f.alloc(node48Len)
-	if addr.isNull() {
-		panic("addr is null")
+func (f *arenaFactory) newNode16() (memdbArenaAddr, *artNode, error) {
+	addr, data, ok := f.popFree(&f.freeNode16, node16Len)
+	if !ok {
+		var err error
+		addr, data, err = f.alloc(node16Len)
+		if err != nil {
+			return nullAddr, nil, err
+		}
+		f.Allocated.Add(1)
 	}
-	anData := data[:artNodeLen]
-	data = data[artNodeLen:]
-	an := (*artNode)(unsafe.Pointer(&anData))
-	an.kind = Node48
-	an.ref = unsafe.Pointer(&data)
-	return an
+	an := newHeader(addr, data, Node16)
+	initNode16(f.getNode16(an))
+	return addr, an, nil
 }
 
-func (f *arenaFactory) newNode256() *artNode {
-	addr, data := f.alloc(node256Len)
-	if addr.isNull() {
-		panic("addr is null")
+func (f *arenaFactory) newNode48() (memdbArenaAddr, *artNode, error) {
+	addr, data, ok := f.popFree(&f.freeNode48, node48Len)
+	if !ok {
+		var err error
+		addr, data, err = f.alloc(node48Len)
+		if err != nil {
+			return nullAddr, nil, err
+		}
+		f.Allocated.Add(1)
 	}
-	anData := data[:artNodeLen]
-	data = data[artNodeLen:]
-	an := (*artNode)(unsafe.Pointer(&anData))
-	an.kind = Node256
-	an.ref = unsafe.Pointer(&data)
-	return an
+	an := newHeader(addr, data, Node48)
+	initNode48(f.getNode48(an))
+	return addr, an, nil
+}
+
+func (f *arenaFactory) newNode256() (memdbArenaAddr, *artNode, error) {
+	addr, data, ok := f.popFree(&f.freeNode256, node256Len)
+	if !ok {
+		var err error
+		addr, data, err = f.alloc(node256Len)
+		if err != nil {
+			return nullAddr, nil, err
+		}
+		f.Allocated.Add(1)
+	}
+	an := newHeader(addr, data, Node256)
+	initNode256(f.getNode256(an))
+	return addr, an, nil
 }
 
-func (f *arenaFactory) newLeaf(key Key, value interface{}) *artNode {
+// leafSentinelIdx tags a memdbArenaAddr as referring to heapLeaves rather
+// than an arena block. Leaves hold a Key slice and an interface{} value;
+// the garbage collector doesn't scan raw arena bytes, so storing a leaf's
+// payload there would let the GC reclaim its key/value out from under it.
+// Leaves therefore live on the Go heap, indexed by this side table, while
+// still being addressable by memdbArenaAddr like every other node so a
+// parent's child slot can point at one uniformly.
+const leafSentinelIdx = math.MaxUint32 - 1
+
+func (f *arenaFactory) newLeaf(key Key, value interface{}) (memdbArenaAddr, *artNode, error) {
 	clonedKey := make(Key, len(key))
 	copy(clonedKey, key)
-	return &artNode{
-		kind: Leaf,
-		ref:  unsafe.Pointer(&leaf{key: clonedKey, value: value}),
+
+	f.leavesMu.Lock()
+	f.heapLeaves = append(f.heapLeaves, &leaf{key: clonedKey, value: value})
+	off := len(f.heapLeaves) - 1
+	f.leavesMu.Unlock()
+
+	addr := memdbArenaAddr{idx: leafSentinelIdx, off: uint32(off)}
+	return addr, &artNode{kind: Leaf, ref: addr}, nil
+}
+
+func (f *arenaFactory) getLeaf(an *artNode) *leaf {
+	f.leavesMu.RLock()
+	defer f.leavesMu.RUnlock()
+	return f.heapLeaves[an.ref.off]
+}
+
+// getArtNode resolves an arena address back into the *artNode that lives at
+// that offset - the inverse of the addr returned by newNode4/16/48/256 and
+// newLeaf. node4/16/48/256 child slots store these addresses instead of
+// unsafe.Pointer so a slot survives block growth: it no longer pins a Go
+// pointer into a block's buf.
+func (f *arenaFactory) getArtNode(addr memdbArenaAddr) *artNode {
+	if addr.isNull() {
+		return nil
+	}
+	if addr.idx == leafSentinelIdx {
+		return &artNode{kind: Leaf, ref: addr}
 	}
+	data := f.dataAt(addr, artNodeLen)
+	return (*artNode)(unsafe.Pointer(&data[0]))
 }
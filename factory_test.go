@@ -0,0 +1,95 @@
+package art
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTreesHaveIndependentCapacity(t *testing.T) {
+	bounded := newTree(WithMaxCapacity(10))
+	unbounded := newTree()
+
+	if err := bounded.Insert(Key("a"), 1); err != nil {
+		t.Fatalf("Insert(a) on bounded tree: %v", err)
+	}
+	// The second insert forces a split, which needs the first arena block;
+	// the 10 byte budget can't fit it, so Insert should surface ErrArenaFull.
+	if err := bounded.Insert(Key("b"), 2); err != ErrArenaFull {
+		t.Fatalf("Insert(b) on bounded tree = %v; want ErrArenaFull", err)
+	}
+
+	if err := unbounded.Insert(Key("a"), 1); err != nil {
+		t.Fatalf("Insert(a) on unbounded tree: %v", err)
+	}
+	if err := unbounded.Insert(Key("b"), 2); err != nil {
+		t.Fatalf("Insert(b) on unbounded tree: %v", err)
+	}
+	if unbounded.factory.Capacity() == 0 {
+		t.Fatalf("unbounded tree never grew its arena")
+	}
+	if bounded.factory.Capacity() != 0 {
+		t.Fatalf("bounded tree's failed grow should not have left behind a block, got capacity %d", bounded.factory.Capacity())
+	}
+}
+
+// TestConcurrentReadDuringGrowth has one goroutine allocating enough node4s
+// to force the arena past its first block repeatedly (growActive), while
+// another goroutine repeatedly reads a node allocated before either
+// goroutine started. Run with -race: dataAt and getArtNode resolve a
+// memdbArenaAddr by indexing f.blocks directly, which races against
+// growActive's append unless both sides go through growMu.
+//
+// This goes through newNode4/getNode4 directly rather than tree.Insert and
+// tree.Search: tree.root itself is a plain field read by Search and written
+// by every Insert, which is its own pre-existing, unsynchronized race
+// unrelated to the one this test targets (dataAt/getArtNode vs growActive),
+// and not something a single allocator-level test should paper over by
+// coincidentally never tripping it.
+func TestConcurrentReadDuringGrowth(t *testing.T) {
+	f := newArenaFactory()
+
+	_, stableAN, err := f.newNode4()
+	if err != nil {
+		t.Fatalf("newNode4: %v", err)
+	}
+	f.getNode4(stableAN).keys[0] = 0x42
+
+	const numAllocs = 4096
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for i := 0; i < numAllocs; i++ {
+			if _, _, err := f.newNode4(); err != nil {
+				t.Errorf("newNode4: %v", err)
+				return
+			}
+		}
+	}()
+
+	var readerWG sync.WaitGroup
+	readerWG.Add(1)
+	go func() {
+		defer readerWG.Done()
+		for {
+			select {
+			case <-writerDone:
+				return
+			default:
+				if got := f.getNode4(stableAN).keys[0]; got != 0x42 {
+					t.Errorf("stable node4's keys[0] = %#x; want 0x42", got)
+					return
+				}
+			}
+		}
+	}()
+
+	<-writerDone
+	readerWG.Wait()
+
+	if f.Capacity() <= initBlockSize {
+		t.Fatalf("arena never grew past its initial block, got capacity %d", f.Capacity())
+	}
+	if got := f.getNode4(stableAN).keys[0]; got != 0x42 {
+		t.Fatalf("stable node4's keys[0] = %#x; want 0x42", got)
+	}
+}
@@ -0,0 +1,48 @@
+package art
+
+// freeNode returns the arena slot at addr to the freelist for kind, zeroing
+// it first so the next newNodeN to reuse it (via popFree) starts clean.
+// Call this whenever a node is abandoned: a node4/16/48/256 growing into the
+// next size, or an explicit delete.
+func (f *arenaFactory) freeNode(kind uint8, addr memdbArenaAddr, size int) {
+	f.recordMutation(addr, size)
+	data := f.dataAt(addr, size)
+	for i := range data {
+		data[i] = 0
+	}
+	switch kind {
+	case Node4:
+		f.freeNode4 = append(f.freeNode4, addr)
+	case Node16:
+		f.freeNode16 = append(f.freeNode16, addr)
+	case Node48:
+		f.freeNode48 = append(f.freeNode48, addr)
+	case Node256:
+		f.freeNode256 = append(f.freeNode256, addr)
+	}
+}
+
+// popFree pops an address off list, if any, returning the size bytes at that
+// address ready to be reinitialized by the caller. It reports ok=false when
+// the freelist is empty and the caller should fall back to alloc.
+func (f *arenaFactory) popFree(list *[]memdbArenaAddr, size int) (memdbArenaAddr, []byte, bool) {
+	n := len(*list)
+	if n == 0 {
+		return nullAddr, nil, false
+	}
+	addr := (*list)[n-1]
+	*list = (*list)[:n-1]
+	f.Reused.Add(1)
+	return addr, f.dataAt(addr, size), true
+}
+
+// dataAt returns the size bytes starting at addr within their owning block.
+// It takes growMu's read side around indexing f.blocks: a concurrent
+// growActive can append to that slice (reallocating its backing array)
+// while this runs, which would otherwise race on the slice header itself,
+// not just on the bytes returned.
+func (f *arenaFactory) dataAt(addr memdbArenaAddr, size int) []byte {
+	f.growMu.RLock()
+	defer f.growMu.RUnlock()
+	return f.blocks[addr.idx].buf[addr.off : addr.off+uint32(size)]
+}
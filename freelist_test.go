@@ -0,0 +1,89 @@
+package art
+
+import "testing"
+
+func TestFreelistReusesFreedNode4(t *testing.T) {
+	tr := newTree()
+	tr.Insert(Key("a"), 1)
+	tr.Insert(Key("b"), 2)
+	tr.Insert(Key("c"), 3)
+	tr.Insert(Key("d"), 4)
+	// A 5th byte-keyed child overflows the node4's 4 slots, growing it into a
+	// node16 and freeing the old node4 via growTo4to16.
+	tr.Insert(Key("e"), 5)
+	if len(tr.factory.freeNode4) == 0 {
+		t.Fatalf("expected the abandoned node4 to be on the freelist")
+	}
+
+	reusedBefore := tr.factory.Reused.Load()
+	// "fg"/"fh" share a prefix that doesn't exist in the tree yet, so
+	// inserting both forces a fresh node4 split - it should come from the
+	// freelist instead of a new arena allocation.
+	tr.Insert(Key("fg"), 6)
+	tr.Insert(Key("fh"), 7)
+
+	if got := tr.factory.Reused.Load(); got != reusedBefore+1 {
+		t.Fatalf("Reused = %d; want %d (freed node4 should have been recycled)", got, reusedBefore+1)
+	}
+	if v, ok := tr.Search(Key("fg")); !ok || v != 6 {
+		t.Fatalf("Search(fg) = %v, %v; want 6, true", v, ok)
+	}
+	if v, ok := tr.Search(Key("fh")); !ok || v != 7 {
+		t.Fatalf("Search(fh) = %v, %v; want 7, true", v, ok)
+	}
+}
+
+func TestDeleteFreesEmptiedNodes(t *testing.T) {
+	tr := newTree()
+	tr.Insert(Key("a"), 1)
+	tr.Insert(Key("b"), 2)
+
+	if !tr.Delete(Key("a")) {
+		t.Fatalf("Delete(a) = false; want true")
+	}
+	if _, ok := tr.Search(Key("a")); ok {
+		t.Fatalf("Search(a) after Delete = found; want not found")
+	}
+	if v, ok := tr.Search(Key("b")); !ok || v != 2 {
+		t.Fatalf("Search(b) after deleting a = %v, %v; want 2, true", v, ok)
+	}
+
+	if !tr.Delete(Key("b")) {
+		t.Fatalf("Delete(b) = false; want true")
+	}
+	if !tr.root.isNull() {
+		t.Fatalf("root should be null once every key is deleted")
+	}
+	if len(tr.factory.freeNode4) == 0 {
+		t.Fatalf("expected the now-empty node4 root to be recycled")
+	}
+}
+
+// TestDeleteFreesEmptiedNodeViaZeroChild covers the case where a node is
+// emptied by its zeroChild going away rather than a byte-keyed child: "a" is
+// a prefix of "ab", so under the root node4's 'a' slot sits a second node4
+// whose zeroChild holds "a" and whose 'b'-keyed child holds "ab". Deleting
+// "ab" then "a" must free that node4 (and then the root node4 it empties)
+// just like the all-byte-keyed case in TestDeleteFreesEmptiedNodes.
+func TestDeleteFreesEmptiedNodeViaZeroChild(t *testing.T) {
+	tr := newTree()
+	tr.Insert(Key("a"), 1)
+	tr.Insert(Key("ab"), 2)
+
+	if !tr.Delete(Key("ab")) {
+		t.Fatalf("Delete(ab) = false; want true")
+	}
+	if v, ok := tr.Search(Key("a")); !ok || v != 1 {
+		t.Fatalf("Search(a) after deleting ab = %v, %v; want 1, true", v, ok)
+	}
+
+	if !tr.Delete(Key("a")) {
+		t.Fatalf("Delete(a) = false; want true")
+	}
+	if !tr.root.isNull() {
+		t.Fatalf("root should be null once every key is deleted")
+	}
+	if len(tr.factory.freeNode4) == 0 {
+		t.Fatalf("expected the node4 emptied via zeroChild to be recycled")
+	}
+}
@@ -0,0 +1,478 @@
+package art
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+// Key is the byte sequence a tree is keyed on.
+type Key []byte
+
+// Node kinds, stored in artNode.kind and used to pick which of
+// node4/16/48/256's payload a ref addresses.
+const (
+	Leaf uint8 = iota + 1
+	Node4
+	Node16
+	Node48
+	Node256
+)
+
+// artNode is the common header every node in the tree starts with. It fits
+// within the 16 bytes (artNodeLen) newNode4/16/48/256 reserve ahead of their
+// payload. ref addresses that payload - the node4/16/48/256 struct
+// for an internal node, or the heapLeaves slot for a Leaf - via the arena
+// addressing scheme described on getArtNode.
+type artNode struct {
+	kind uint8
+	ref  memdbArenaAddr
+}
+
+// leaf is a key/value pair. It lives on the Go heap (see leafSentinelIdx),
+// not in an arena block.
+type leaf struct {
+	key   Key
+	value interface{}
+}
+
+// node4/16/48/256 hold their children as memdbArenaAddr rather than
+// unsafe.Pointer so a slot stays valid across arena block growth. Each also
+// has a zeroChild: the child reached when a key ends exactly at this node's
+// depth, distinct from children which are keyed by the key's next byte.
+// This repo's tree does no path compression, so every byte of a key gets
+// its own level; zeroChild is what lets shorter keys terminate inside the
+// trie formed by their own prefixes.
+type node4 struct {
+	count     uint8
+	keys      [4]byte
+	children  [4]memdbArenaAddr
+	zeroChild memdbArenaAddr
+}
+
+type node16 struct {
+	count     uint8
+	keys      [16]byte
+	children  [16]memdbArenaAddr
+	zeroChild memdbArenaAddr
+}
+
+type node48 struct {
+	count     uint8
+	keys      [48]byte
+	children  [48]memdbArenaAddr
+	zeroChild memdbArenaAddr
+}
+
+type node256 struct {
+	count     uint16
+	children  [256]memdbArenaAddr
+	zeroChild memdbArenaAddr
+}
+
+const (
+	node4PayloadSize   = unsafe.Sizeof(node4{})
+	node16PayloadSize  = unsafe.Sizeof(node16{})
+	node48PayloadSize  = unsafe.Sizeof(node48{})
+	node256PayloadSize = unsafe.Sizeof(node256{})
+)
+
+func initNode4(n *node4) {
+	n.count = 0
+	n.zeroChild = nullAddr
+	for i := range n.children {
+		n.children[i] = nullAddr
+	}
+}
+
+func initNode16(n *node16) {
+	n.count = 0
+	n.zeroChild = nullAddr
+	for i := range n.children {
+		n.children[i] = nullAddr
+	}
+}
+
+func initNode48(n *node48) {
+	n.count = 0
+	n.zeroChild = nullAddr
+	for i := range n.children {
+		n.children[i] = nullAddr
+	}
+}
+
+func initNode256(n *node256) {
+	n.count = 0
+	n.zeroChild = nullAddr
+	for i := range n.children {
+		n.children[i] = nullAddr
+	}
+}
+
+func (f *arenaFactory) getNode4(an *artNode) *node4 {
+	data := f.dataAt(an.ref, int(node4PayloadSize))
+	return (*node4)(unsafe.Pointer(&data[0]))
+}
+
+func (f *arenaFactory) getNode16(an *artNode) *node16 {
+	data := f.dataAt(an.ref, int(node16PayloadSize))
+	return (*node16)(unsafe.Pointer(&data[0]))
+}
+
+func (f *arenaFactory) getNode48(an *artNode) *node48 {
+	data := f.dataAt(an.ref, int(node48PayloadSize))
+	return (*node48)(unsafe.Pointer(&data[0]))
+}
+
+func (f *arenaFactory) getNode256(an *artNode) *node256 {
+	data := f.dataAt(an.ref, int(node256PayloadSize))
+	return (*node256)(unsafe.Pointer(&data[0]))
+}
+
+// findChild returns the address stored for key, or nullAddr if there is no
+// such child.
+func (f *arenaFactory) findChild(an *artNode, key byte) memdbArenaAddr {
+	switch an.kind {
+	case Node4:
+		n := f.getNode4(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				return n.children[i]
+			}
+		}
+	case Node16:
+		n := f.getNode16(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				return n.children[i]
+			}
+		}
+	case Node48:
+		n := f.getNode48(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				return n.children[i]
+			}
+		}
+	case Node256:
+		return f.getNode256(an).children[key]
+	}
+	return nullAddr
+}
+
+// zeroChildOf returns the child reached when a key ends exactly at an.
+func (f *arenaFactory) zeroChildOf(an *artNode) memdbArenaAddr {
+	switch an.kind {
+	case Node4:
+		return f.getNode4(an).zeroChild
+	case Node16:
+		return f.getNode16(an).zeroChild
+	case Node48:
+		return f.getNode48(an).zeroChild
+	case Node256:
+		return f.getNode256(an).zeroChild
+	}
+	return nullAddr
+}
+
+// setZeroChild sets the child reached when a key ends exactly at an. Unlike
+// setChild, this never grows an: zeroChild is a single fixed field on every
+// node kind, not a capacity-limited slot.
+func (f *arenaFactory) setZeroChild(an *artNode, addr memdbArenaAddr) {
+	f.recordNodeMutation(an)
+	switch an.kind {
+	case Node4:
+		f.getNode4(an).zeroChild = addr
+	case Node16:
+		f.getNode16(an).zeroChild = addr
+	case Node48:
+		f.getNode48(an).zeroChild = addr
+	case Node256:
+		f.getNode256(an).zeroChild = addr
+	}
+}
+
+// nodePayloadSize reports how many bytes an.ref addresses, for the node
+// kinds that live in an arena block (a Leaf's payload lives in heapLeaves
+// instead, see getLeaf).
+func nodePayloadSize(kind uint8) int {
+	switch kind {
+	case Node4:
+		return int(node4PayloadSize)
+	case Node16:
+		return int(node16PayloadSize)
+	case Node48:
+		return int(node48PayloadSize)
+	case Node256:
+		return int(node256PayloadSize)
+	}
+	return 0
+}
+
+// recordNodeMutation journals an's current payload bytes, via
+// arenaFactory.recordMutation, before an in-place write clobbers them. This
+// is what lets Cleanup roll back an ordinary insert into an already-grown
+// node, as opposed to one that only allocated fresh nodes.
+func (f *arenaFactory) recordNodeMutation(an *artNode) {
+	if an.kind == Leaf {
+		return
+	}
+	f.recordMutation(an.ref, nodePayloadSize(an.kind))
+}
+
+// setChild stores childAddr under key in the node at nodeAddr, growing it to
+// the next node kind first if it's already at capacity. It returns the
+// (possibly new) address and header of the node the caller should use from
+// now on.
+func (f *arenaFactory) setChild(nodeAddr memdbArenaAddr, an *artNode, key byte, childAddr memdbArenaAddr) (memdbArenaAddr, *artNode, error) {
+	f.recordNodeMutation(an)
+	switch an.kind {
+	case Node4:
+		n := f.getNode4(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				n.children[i] = childAddr
+				return nodeAddr, an, nil
+			}
+		}
+		if n.count < uint8(len(n.keys)) {
+			n.keys[n.count] = key
+			n.children[n.count] = childAddr
+			n.count++
+			return nodeAddr, an, nil
+		}
+		return f.growTo4to16(nodeAddr, n, key, childAddr)
+	case Node16:
+		n := f.getNode16(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				n.children[i] = childAddr
+				return nodeAddr, an, nil
+			}
+		}
+		if n.count < uint8(len(n.keys)) {
+			n.keys[n.count] = key
+			n.children[n.count] = childAddr
+			n.count++
+			return nodeAddr, an, nil
+		}
+		return f.growTo16to48(nodeAddr, n, key, childAddr)
+	case Node48:
+		n := f.getNode48(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				n.children[i] = childAddr
+				return nodeAddr, an, nil
+			}
+		}
+		if n.count < uint8(len(n.keys)) {
+			n.keys[n.count] = key
+			n.children[n.count] = childAddr
+			n.count++
+			return nodeAddr, an, nil
+		}
+		return f.growTo48to256(nodeAddr, n, key, childAddr)
+	case Node256:
+		n := f.getNode256(an)
+		if n.children[key].isNull() {
+			n.count++
+		}
+		n.children[key] = childAddr
+		return nodeAddr, an, nil
+	}
+	return nullAddr, nil, errUnknownNodeKind
+}
+
+func (f *arenaFactory) growTo4to16(oldAddr memdbArenaAddr, old *node4, key byte, childAddr memdbArenaAddr) (memdbArenaAddr, *artNode, error) {
+	newAddr, newAN, err := f.newNode16()
+	if err != nil {
+		return nullAddr, nil, err
+	}
+	n := f.getNode16(newAN)
+	n.zeroChild = old.zeroChild
+	n.count = old.count
+	copy(n.keys[:], old.keys[:old.count])
+	copy(n.children[:], old.children[:old.count])
+	n.keys[n.count] = key
+	n.children[n.count] = childAddr
+	n.count++
+	f.freeNode(Node4, oldAddr, node4Len)
+	return newAddr, newAN, nil
+}
+
+func (f *arenaFactory) growTo16to48(oldAddr memdbArenaAddr, old *node16, key byte, childAddr memdbArenaAddr) (memdbArenaAddr, *artNode, error) {
+	newAddr, newAN, err := f.newNode48()
+	if err != nil {
+		return nullAddr, nil, err
+	}
+	n := f.getNode48(newAN)
+	n.zeroChild = old.zeroChild
+	n.count = old.count
+	copy(n.keys[:], old.keys[:old.count])
+	copy(n.children[:], old.children[:old.count])
+	n.keys[n.count] = key
+	n.children[n.count] = childAddr
+	n.count++
+	f.freeNode(Node16, oldAddr, node16Len)
+	return newAddr, newAN, nil
+}
+
+func (f *arenaFactory) growTo48to256(oldAddr memdbArenaAddr, old *node48, key byte, childAddr memdbArenaAddr) (memdbArenaAddr, *artNode, error) {
+	newAddr, newAN, err := f.newNode256()
+	if err != nil {
+		return nullAddr, nil, err
+	}
+	n := f.getNode256(newAN)
+	n.zeroChild = old.zeroChild
+	for i := uint8(0); i < old.count; i++ {
+		n.children[old.keys[i]] = old.children[i]
+	}
+	n.count = uint16(old.count)
+	n.children[key] = childAddr
+	n.count++
+	f.freeNode(Node48, oldAddr, node48Len)
+	return newAddr, newAN, nil
+}
+
+// nodeChunkLen reports the full arena chunk size (header + payload) for
+// kind, matching what newNode4/16/48/256 allocated and what freeNode/popFree
+// expect to find on the freelist.
+func nodeChunkLen(kind uint8) int {
+	switch kind {
+	case Node4:
+		return node4Len
+	case Node16:
+		return node16Len
+	case Node48:
+		return node48Len
+	case Node256:
+		return node256Len
+	}
+	return 0
+}
+
+// removeChildSlot drops key's slot from the node at nodeAddr, compacting the
+// keys/children arrays in place. It reports whether the node is now empty
+// (no remaining byte-keyed children and no zeroChild), in which case the
+// caller should treat nodeAddr itself as removed.
+func (f *arenaFactory) removeChildSlot(nodeAddr memdbArenaAddr, an *artNode, key byte) (memdbArenaAddr, bool) {
+	f.recordNodeMutation(an)
+	switch an.kind {
+	case Node4:
+		n := f.getNode4(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				last := n.count - 1
+				n.keys[i] = n.keys[last]
+				n.children[i] = n.children[last]
+				n.children[last] = nullAddr
+				n.count--
+				break
+			}
+		}
+	case Node16:
+		n := f.getNode16(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				last := n.count - 1
+				n.keys[i] = n.keys[last]
+				n.children[i] = n.children[last]
+				n.children[last] = nullAddr
+				n.count--
+				break
+			}
+		}
+	case Node48:
+		n := f.getNode48(an)
+		for i := uint8(0); i < n.count; i++ {
+			if n.keys[i] == key {
+				last := n.count - 1
+				n.keys[i] = n.keys[last]
+				n.children[i] = n.children[last]
+				n.children[last] = nullAddr
+				n.count--
+				break
+			}
+		}
+	case Node256:
+		n := f.getNode256(an)
+		if !n.children[key].isNull() {
+			n.children[key] = nullAddr
+			n.count--
+		}
+	}
+	return nodeAddr, f.nodeIsEmpty(an)
+}
+
+// nodeIsEmpty reports whether an internal node has no remaining byte-keyed
+// children and no zeroChild, i.e. it holds nothing a key could reach and the
+// caller should treat it as removed. Used by both removeChildSlot (a
+// byte-keyed child going away) and delete's zero-child branch (the zeroChild
+// itself going away), since either can be what empties a node.
+func (f *arenaFactory) nodeIsEmpty(an *artNode) bool {
+	switch an.kind {
+	case Node4:
+		n := f.getNode4(an)
+		return n.count == 0 && n.zeroChild.isNull()
+	case Node16:
+		n := f.getNode16(an)
+		return n.count == 0 && n.zeroChild.isNull()
+	case Node48:
+		n := f.getNode48(an)
+		return n.count == 0 && n.zeroChild.isNull()
+	case Node256:
+		n := f.getNode256(an)
+		return n.count == 0 && n.zeroChild.isNull()
+	}
+	return false
+}
+
+// delete removes key from the subtree rooted at nodeAddr, if present. It
+// returns the address the caller should store in place of nodeAddr - nullAddr
+// if the whole subtree was removed - and whether key was found at all.
+// Internal nodes emptied by a removal are recycled via freeNode, the same
+// freelists growTo4to16/16to48/48to256 feed on the insert side.
+func (f *arenaFactory) delete(nodeAddr memdbArenaAddr, key Key, depth int) (memdbArenaAddr, bool) {
+	if nodeAddr.isNull() {
+		return nodeAddr, false
+	}
+
+	an := f.getArtNode(nodeAddr)
+	if an.kind == Leaf {
+		if !bytes.Equal(f.getLeaf(an).key, key) {
+			return nodeAddr, false
+		}
+		return nullAddr, true
+	}
+
+	keyByte, hasByte := childKeyAt(key, depth)
+	if !hasByte {
+		child := f.zeroChildOf(an)
+		newChild, removed := f.delete(child, key, depth+1)
+		if !removed {
+			return nodeAddr, false
+		}
+		f.setZeroChild(an, newChild)
+		if f.nodeIsEmpty(an) {
+			f.freeNode(an.kind, nodeAddr, nodeChunkLen(an.kind))
+			return nullAddr, true
+		}
+		return nodeAddr, true
+	}
+
+	child := f.findChild(an, keyByte)
+	newChild, removed := f.delete(child, key, depth+1)
+	if !removed {
+		return nodeAddr, false
+	}
+	if !newChild.isNull() {
+		newNodeAddr, _, _ := f.setChild(nodeAddr, an, keyByte, newChild)
+		return newNodeAddr, true
+	}
+
+	na, empty := f.removeChildSlot(nodeAddr, an, keyByte)
+	if empty {
+		f.freeNode(an.kind, na, nodeChunkLen(an.kind))
+		return nullAddr, true
+	}
+	return na, true
+}
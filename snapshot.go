@@ -0,0 +1,158 @@
+package art
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// snapshotVersion guards the on-disk layout written by WriteSnapshot. Bump
+// it whenever the format below changes so LoadSnapshot can refuse to
+// misinterpret an older/newer file instead of silently corrupting reads.
+const snapshotVersion uint32 = 1
+
+var order = binary.LittleEndian
+
+// leafSnapshot mirrors leaf with exported fields, since gob can't encode
+// leaf's unexported ones. Leaves live on the Go heap rather than in an arena
+// block (see leafSentinelIdx), so they need their own encoding step distinct
+// from the raw block bytes writeSnapshot writes; Value's concrete type must be
+// registered with gob.Register by the caller if it isn't a predeclared type.
+type leafSnapshot struct {
+	Key   Key
+	Value interface{}
+}
+
+// WriteSnapshot writes the tree's entire arena - every block's raw bytes
+// plus the root address - to w. Because nodes address each other by
+// memdbArenaAddr rather than by Go pointer, the blocks can be written out
+// and read back verbatim: no pointer fixups are needed on reload.
+func (t *tree) WriteSnapshot(w io.Writer) error {
+	return t.factory.writeSnapshot(w, t.root)
+}
+
+// writeSnapshot holds growMu for the whole write, the same lock growActive
+// takes to append a block. Without it, a concurrent insert growing the arena
+// could append to f.blocks (reallocating its backing array) while this
+// range is iterating it - a data race on the slice header itself, not just
+// on block contents. It separately takes leavesMu - the lock newLeaf holds
+// while appending to heapLeaves - around the read of that slice below, for
+// the same reason: growMu only protects f.blocks.
+func (f *arenaFactory) writeSnapshot(w io.Writer, root memdbArenaAddr) error {
+	f.growMu.Lock()
+	defer f.growMu.Unlock()
+
+	header := []uint32{snapshotVersion, uint32(ptrSize), uint32(len(f.blocks)), root.idx, root.off}
+	for _, v := range header {
+		if err := binary.Write(w, order, v); err != nil {
+			return err
+		}
+	}
+
+	for i := range f.blocks {
+		length := f.blocks[i].length.Load()
+		if err := binary.Write(w, order, length); err != nil {
+			return err
+		}
+		if _, err := w.Write(f.blocks[i].buf[:length]); err != nil {
+			return err
+		}
+	}
+
+	f.leavesMu.RLock()
+	leafSnaps := make([]leafSnapshot, len(f.heapLeaves))
+	for i, lf := range f.heapLeaves {
+		leafSnaps[i] = leafSnapshot{Key: lf.key, Value: lf.value}
+	}
+	f.leavesMu.RUnlock()
+	var leafBuf bytes.Buffer
+	if err := gob.NewEncoder(&leafBuf).Encode(leafSnaps); err != nil {
+		return err
+	}
+	if err := binary.Write(w, order, uint64(leafBuf.Len())); err != nil {
+		return err
+	}
+	if _, err := w.Write(leafBuf.Bytes()); err != nil {
+		return err
+	}
+
+	return binary.Write(w, order, [2]uint32{root.idx, root.off})
+}
+
+// ptrSize is recorded in the snapshot header purely as a diagnostic: a
+// snapshot written on a platform with a different pointer width than the
+// one loading it is a strong hint of an incompatible build, even though the
+// arena bytes themselves don't otherwise depend on it.
+const ptrSize = 32 << (^uintptr(0) >> 63) / 8
+
+// LoadSnapshot reads a snapshot written by WriteSnapshot and reconstructs an
+// independent tree backed by a freshly populated arena. It never touches any
+// other tree's arena.
+func LoadSnapshot(r io.Reader) (*tree, error) {
+	var version, snapPtrSize, blockCount, rootIdx, rootOff uint32
+	for _, dst := range []*uint32{&version, &snapPtrSize, &blockCount, &rootIdx, &rootOff} {
+		if err := binary.Read(r, order, dst); err != nil {
+			return nil, err
+		}
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("art: snapshot version %d is not supported (want %d)", version, snapshotVersion)
+	}
+
+	f := newArenaFactory()
+	// Sized up front and filled in by index rather than appended to: each
+	// memdbArenaBlock embeds an atomic.Uint64, and append would copy a
+	// memdbArenaBlock value on every grow of the slice.
+	f.blocks = make([]memdbArenaBlock, blockCount)
+	for i := uint32(0); i < blockCount; i++ {
+		var length uint64
+		if err := binary.Read(r, order, &length); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		f.blocks[i].buf = buf
+		f.blocks[i].idx = i
+		f.blocks[i].length.Store(length)
+		f.capacity.Add(uint64(len(buf)))
+	}
+	if len(f.blocks) > 0 {
+		last := &f.blocks[len(f.blocks)-1]
+		f.blockSize = len(last.buf)
+		f.active.Store(last)
+	}
+
+	var leafBytesLen uint64
+	if err := binary.Read(r, order, &leafBytesLen); err != nil {
+		return nil, err
+	}
+	leafBytes := make([]byte, leafBytesLen)
+	if _, err := io.ReadFull(r, leafBytes); err != nil {
+		return nil, err
+	}
+	var leafSnaps []leafSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(leafBytes)).Decode(&leafSnaps); err != nil {
+		return nil, err
+	}
+	f.heapLeaves = make([]*leaf, len(leafSnaps))
+	for i, ls := range leafSnaps {
+		f.heapLeaves[i] = &leaf{key: ls.Key, value: ls.Value}
+	}
+
+	var trailerIdx, trailerOff uint32
+	if err := binary.Read(r, order, &trailerIdx); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, order, &trailerOff); err != nil {
+		return nil, err
+	}
+	if trailerIdx != rootIdx || trailerOff != rootOff {
+		return nil, fmt.Errorf("art: snapshot root address mismatch, file is truncated or corrupt")
+	}
+
+	return &tree{root: memdbArenaAddr{idx: rootIdx, off: rootOff}, factory: f}, nil
+}
@@ -0,0 +1,41 @@
+package art
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	tr := newTree()
+	want := map[string]int{"a": 1, "b": 2, "fg": 3, "fh": 4, "z": 5}
+	for k, v := range want {
+		if err := tr.Insert(Key(k), v); err != nil {
+			t.Fatalf("Insert(%s): %v", k, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tr.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+
+	loaded, err := LoadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	for k, v := range want {
+		got, ok := loaded.Search(Key(k))
+		if !ok || got != v {
+			t.Fatalf("loaded.Search(%s) = %v, %v; want %v, true", k, got, ok, v)
+		}
+	}
+
+	// The loaded tree must not share state with the original: mutating one
+	// shouldn't affect the other.
+	if err := loaded.Insert(Key("new"), 6); err != nil {
+		t.Fatalf("Insert on loaded tree: %v", err)
+	}
+	if _, ok := tr.Search(Key("new")); ok {
+		t.Fatalf("original tree observed a key inserted into the loaded tree")
+	}
+}
@@ -0,0 +1,183 @@
+package art
+
+// StagingHandle identifies a nested savepoint opened with Stage. Handles must
+// be released or cleaned up in stack order: the most recently opened handle
+// is the only one that can be released or cleaned up next.
+type StagingHandle int
+
+// nullStagingHandle is a StagingHandle that names no frame. Stage never
+// returns it: it always returns the index of the frame it pushed.
+const nullStagingHandle StagingHandle = -1
+
+// journalEntry records the previous bytes at addr so a mutation can be
+// undone without knowing anything about node layout.
+type journalEntry struct {
+	addr     memdbArenaAddr
+	oldValue []byte
+}
+
+// stageFrame is one level of the savepoint stack. blockIdx/length capture the
+// arena's append position at the moment Stage was called, so Cleanup can
+// simply truncate newly allocated nodes away instead of journaling them.
+// root and heapLeavesLen capture the other pieces of state a mutation can
+// change that don't live in the journaled arena bytes: root is the tree's
+// root address before the stage started (setChild/splitLeaf can replace the
+// root itself, not just write through it), and heapLeavesLen is how many
+// heap-allocated leaves existed, so a leaf created during the stage can be
+// dropped again rather than left dangling (see leafSentinelIdx). The
+// freeNodeNLen fields do the same for freeNode's per-size freelists: a
+// grow or delete during the stage can push an abandoned slot onto one of
+// them, and Cleanup has to pop those back off too, or a later unrelated
+// newNodeN could hand out a slot that Cleanup just restored live content
+// into.
+//
+// Stage/Release/Cleanup/recordMutation are serialized against each other by
+// arenaFactory.stageMu, but that does not make them safe against a
+// concurrent alloc (and therefore Insert/Delete) from another goroutine:
+// they still read and mutate f.blocks directly rather than going through the
+// atomic active pointer. Callers must serialize staging with any concurrent
+// tree mutation themselves.
+type stageFrame struct {
+	blockIdx       int
+	length         uint64
+	journal        []journalEntry
+	root           memdbArenaAddr
+	heapLeavesLen  int
+	freeNode4Len   int
+	freeNode16Len  int
+	freeNode48Len  int
+	freeNode256Len int
+}
+
+// Stage opens a new savepoint and returns a handle that can later be passed
+// to Release (keep the mutations, merge them into the parent frame) or
+// Cleanup (undo everything done since this call). Stages nest: calling Stage
+// again before releasing/cleaning up the previous one pushes another frame
+// onto the stack. root is the tree's current root address, captured so
+// Cleanup can hand it back if the stage replaced the root entirely.
+func (f *arenaFactory) Stage(root memdbArenaAddr) StagingHandle {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+
+	idx := len(f.blocks) - 1
+	var length uint64
+	if idx >= 0 {
+		length = f.blocks[idx].length.Load()
+	}
+	f.stages = append(f.stages, stageFrame{
+		blockIdx:       idx,
+		length:         length,
+		root:           root,
+		heapLeavesLen:  len(f.heapLeaves),
+		freeNode4Len:   len(f.freeNode4),
+		freeNode16Len:  len(f.freeNode16),
+		freeNode48Len:  len(f.freeNode48),
+		freeNode256Len: len(f.freeNode256),
+	})
+	return StagingHandle(len(f.stages) - 1)
+}
+
+// Release merges the frame at h into its parent, so a Cleanup of an
+// enclosing stage still undoes it. It is a no-op for the outermost frame
+// beyond popping it off the stack.
+func (f *arenaFactory) Release(h StagingHandle) {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+
+	f.checkStagingHandle(h)
+	frame := f.stages[h]
+	f.stages = f.stages[:h]
+	if len(f.stages) > 0 {
+		parent := &f.stages[len(f.stages)-1]
+		parent.journal = append(parent.journal, frame.journal...)
+	}
+}
+
+// Cleanup reverts every mutation recorded since the matching Stage call:
+// journaled (addr, oldValue) writes are restored in reverse order, any
+// arena blocks allocated during the stage are truncated back to the
+// pre-stage length (or dropped entirely if the stage allocated a whole new
+// block), leaves created during the stage are dropped from heapLeaves,
+// slots pushed onto a freeNodeN list during the stage are popped back off,
+// and the tree's root address from before the stage is handed back so the
+// caller can restore it - a stage can replace the root itself (inserting
+// into an empty tree, or growing/emptying the root node), which isn't
+// captured by the journal or the block bookkeeping above.
+func (f *arenaFactory) Cleanup(h StagingHandle) memdbArenaAddr {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+
+	f.checkStagingHandle(h)
+	frame := f.stages[h]
+	f.stages = f.stages[:h]
+
+	for i := len(frame.journal) - 1; i >= 0; i-- {
+		entry := frame.journal[i]
+		copy(f.blocks[entry.addr.idx].buf[entry.addr.off:], entry.oldValue)
+	}
+
+	keep := frame.blockIdx + 1
+	for idx := len(f.blocks) - 1; idx >= keep; idx-- {
+		f.capacity.Add(-uint64(len(f.blocks[idx].buf)))
+	}
+	f.blocks = f.blocks[:keep]
+	if keep == 0 {
+		f.active.Store(nil)
+	} else {
+		f.blocks[keep-1].length.Store(frame.length)
+		f.active.Store(&f.blocks[keep-1])
+	}
+
+	f.leavesMu.Lock()
+	f.heapLeaves = f.heapLeaves[:frame.heapLeavesLen]
+	f.leavesMu.Unlock()
+	f.freeNode4 = f.freeNode4[:frame.freeNode4Len]
+	f.freeNode16 = f.freeNode16[:frame.freeNode16Len]
+	f.freeNode48 = f.freeNode48[:frame.freeNode48Len]
+	f.freeNode256 = f.freeNode256[:frame.freeNode256Len]
+
+	return frame.root
+}
+
+func (f *arenaFactory) checkStagingHandle(h StagingHandle) {
+	if int(h) != len(f.stages)-1 {
+		panic("stage handles must be released/cleaned up in stack order")
+	}
+}
+
+// recordMutation journals the bytes about to be overwritten at addr so the
+// innermost open stage can restore them on Cleanup. It is a no-op when no
+// stage is open, which keeps writes outside of Stage/Release/Cleanup free of
+// journaling overhead.
+func (f *arenaFactory) recordMutation(addr memdbArenaAddr, size int) {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+
+	if len(f.stages) == 0 {
+		return
+	}
+	old := make([]byte, size)
+	copy(old, f.blocks[addr.idx].buf[addr.off:addr.off+uint32(size)])
+	frame := &f.stages[len(f.stages)-1]
+	frame.journal = append(frame.journal, journalEntry{addr: addr, oldValue: old})
+}
+
+// Stage opens a savepoint on the tree's underlying arena. Mutations
+// performed after Stage returns (new leaves, node4->node16 growth, child
+// slot writes, a changed root, ...) can be undone with Cleanup without
+// cloning the tree.
+func (t *tree) Stage() StagingHandle {
+	return t.factory.Stage(t.root)
+}
+
+// Release merges the savepoint h into its parent frame, keeping its
+// mutations.
+func (t *tree) Release(h StagingHandle) {
+	t.factory.Release(h)
+}
+
+// Cleanup reverts every mutation performed since the matching Stage call,
+// including restoring t.root if the stage replaced it.
+func (t *tree) Cleanup(h StagingHandle) {
+	t.root = t.factory.Cleanup(h)
+}
@@ -0,0 +1,70 @@
+package art
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCleanupRollsBackInPlaceChildSlotWrite(t *testing.T) {
+	tr := newTree()
+	if err := tr.Insert(Key("a"), 1); err != nil {
+		t.Fatalf("Insert(a): %v", err)
+	}
+	if err := tr.Insert(Key("b"), 2); err != nil {
+		t.Fatalf("Insert(b): %v", err)
+	}
+
+	h := tr.Stage()
+	if err := tr.Insert(Key("c"), 3); err != nil {
+		t.Fatalf("Insert(c): %v", err)
+	}
+	if v, ok := tr.Search(Key("c")); !ok || v != 3 {
+		t.Fatalf("Search(c) before Cleanup = %v, %v; want 3, true", v, ok)
+	}
+
+	tr.Cleanup(h)
+
+	if _, ok := tr.Search(Key("c")); ok {
+		t.Fatalf("Search(c) after Cleanup = found; want not found")
+	}
+	if v, ok := tr.Search(Key("a")); !ok || v != 1 {
+		t.Fatalf("Search(a) after Cleanup = %v, %v; want 1, true", v, ok)
+	}
+	if v, ok := tr.Search(Key("b")); !ok || v != 2 {
+		t.Fatalf("Search(b) after Cleanup = %v, %v; want 2, true", v, ok)
+	}
+}
+
+// TestInsertDoesNotLeakNodesOnMultiLevelSplitFailure exercises splitLeaf's
+// recursive chain: two keys sharing a long common prefix force insert to
+// recurse through many freshly allocated node4 levels before the keys
+// diverge. With a small enough WithMaxCapacity, the arena runs out partway
+// through that chain; Insert must unwind every node4 it allocated before
+// failing, not just the last one.
+func TestInsertDoesNotLeakNodesOnMultiLevelSplitFailure(t *testing.T) {
+	bounded := newTree(WithMaxCapacity(initBlockSize))
+
+	oldKey := bytes.Repeat([]byte("a"), 61)
+	oldKey[60] = '0'
+	newKey := bytes.Repeat([]byte("a"), 61)
+	newKey[60] = '1'
+
+	if err := bounded.Insert(Key(oldKey), 1); err != nil {
+		t.Fatalf("Insert(oldKey): %v", err)
+	}
+
+	err := bounded.Insert(Key(newKey), 2)
+	if err != ErrArenaFull {
+		t.Fatalf("Insert(newKey) = %v; want ErrArenaFull", err)
+	}
+
+	if got := bounded.factory.Capacity(); got != 0 {
+		t.Fatalf("Capacity() after failed multi-level split = %d; want 0 (no leaked block)", got)
+	}
+	if v, ok := bounded.Search(Key(oldKey)); !ok || v != 1 {
+		t.Fatalf("Search(oldKey) after failed Insert = %v, %v; want 1, true", v, ok)
+	}
+	if _, ok := bounded.Search(Key(newKey)); ok {
+		t.Fatalf("Search(newKey) after failed Insert = found; want not found")
+	}
+}
@@ -0,0 +1,180 @@
+package art
+
+import "bytes"
+
+// tree is an adaptive radix tree. Keys are walked one byte per level (there
+// is no path compression), so nodeAddr always addresses either a Leaf, or
+// an internal node4/16/48/256 whose children are keyed by the key's next
+// byte - see childKeyAt.
+type tree struct {
+	root memdbArenaAddr
+	// factory is this tree's own arena. Each tree gets an independent one
+	// (see newTree) so that WithMaxCapacity, Stage/Release/Cleanup, and
+	// WriteSnapshot/LoadSnapshot on one tree never affect another.
+	factory *arenaFactory
+}
+
+// childKeyAt returns the byte of key that selects a child at depth, and
+// whether key has one: a key shorter than depth+1 terminates at this level,
+// so it belongs under zeroChild rather than a byte-keyed slot.
+func childKeyAt(key Key, depth int) (byte, bool) {
+	if depth >= len(key) {
+		return 0, false
+	}
+	return key[depth], true
+}
+
+// Insert adds or overwrites the value stored under key. It returns
+// ErrArenaFull if the tree was built with WithMaxCapacity and storing the
+// new node(s) would grow the arena past that budget; the tree is left as it
+// was before the call. insert can allocate several nodes before failing -
+// splitLeaf recurses through one node4 per matching prefix byte before two
+// diverging keys land in separate slots - so the attempt runs inside its own
+// stage and is cleaned up on error, rather than leaking the nodes already
+// allocated earlier in that chain.
+func (t *tree) Insert(key Key, value interface{}) error {
+	h := t.factory.Stage(t.root)
+	newRoot, err := t.factory.insert(t.root, key, 0, value)
+	if err != nil {
+		t.root = t.factory.Cleanup(h)
+		return err
+	}
+	t.root = newRoot
+	t.factory.Release(h)
+	return nil
+}
+
+// Search looks up key, reporting whether it is present.
+func (t *tree) Search(key Key) (interface{}, bool) {
+	nodeAddr := t.root
+	depth := 0
+	for {
+		if nodeAddr.isNull() {
+			return nil, false
+		}
+		an := t.factory.getArtNode(nodeAddr)
+		if an.kind == Leaf {
+			lf := t.factory.getLeaf(an)
+			if bytes.Equal(lf.key, key) {
+				return lf.value, true
+			}
+			return nil, false
+		}
+		keyByte, hasByte := childKeyAt(key, depth)
+		if !hasByte {
+			nodeAddr = t.factory.zeroChildOf(an)
+		} else {
+			nodeAddr = t.factory.findChild(an, keyByte)
+		}
+		depth++
+	}
+}
+
+// Delete removes key, reporting whether it was present.
+func (t *tree) Delete(key Key) bool {
+	newRoot, removed := t.factory.delete(t.root, key, 0)
+	if !removed {
+		return false
+	}
+	t.root = newRoot
+	return true
+}
+
+// insert walks (or creates) the subtree rooted at nodeAddr so that key maps
+// to value, returning the address the caller should store in place of
+// nodeAddr - unchanged unless a leaf had to be created or a node grown.
+func (f *arenaFactory) insert(nodeAddr memdbArenaAddr, key Key, depth int, value interface{}) (memdbArenaAddr, error) {
+	if nodeAddr.isNull() {
+		addr, _, err := f.newLeaf(key, value)
+		return addr, err
+	}
+
+	an := f.getArtNode(nodeAddr)
+	if an.kind == Leaf {
+		existing := f.getLeaf(an)
+		if bytes.Equal(existing.key, key) {
+			// A fresh leaf rather than an in-place write to existing, so the
+			// overwrite lands in the parent's journaled child slot (or the
+			// root) and Cleanup can undo it.
+			addr, _, err := f.newLeaf(key, value)
+			return addr, err
+		}
+		return f.splitLeaf(nodeAddr, existing.key, key, value, depth)
+	}
+
+	keyByte, hasByte := childKeyAt(key, depth)
+	if !hasByte {
+		child := f.zeroChildOf(an)
+		newChild, err := f.insert(child, key, depth+1, value)
+		if err != nil {
+			return nullAddr, err
+		}
+		f.setZeroChild(an, newChild)
+		return nodeAddr, nil
+	}
+
+	child := f.findChild(an, keyByte)
+	newChild, err := f.insert(child, key, depth+1, value)
+	if err != nil {
+		return nullAddr, err
+	}
+	newNodeAddr, _, err := f.setChild(nodeAddr, an, keyByte, newChild)
+	return newNodeAddr, err
+}
+
+// splitLeaf replaces the leaf at oldLeafAddr (holding oldKey) with a fresh
+// node4 that holds both oldLeafAddr and a newly created leaf for
+// (newKey, value). If the two keys still agree at depth, the collision is
+// pushed one level deeper by recursing insert on oldLeafAddr itself, which
+// re-enters the Leaf case above and splits again until the keys diverge.
+func (f *arenaFactory) splitLeaf(oldLeafAddr memdbArenaAddr, oldKey, newKey Key, value interface{}, depth int) (memdbArenaAddr, error) {
+	nodeAddr, an, err := f.newNode4()
+	if err != nil {
+		return nullAddr, err
+	}
+
+	oldByte, oldHas := childKeyAt(oldKey, depth)
+	newByte, newHas := childKeyAt(newKey, depth)
+
+	switch {
+	case !oldHas && !newHas:
+		// oldKey and newKey both end exactly at depth, which (since every
+		// byte up to depth already matched) would make them equal - but
+		// insert already ruled that out before calling splitLeaf.
+		panic("art: splitLeaf called with equal keys")
+	case !oldHas:
+		f.setZeroChild(an, oldLeafAddr)
+		newLeafAddr, _, err := f.newLeaf(newKey, value)
+		if err != nil {
+			return nullAddr, err
+		}
+		nodeAddr, _, err = f.setChild(nodeAddr, an, newByte, newLeafAddr)
+		return nodeAddr, err
+	case !newHas:
+		newLeafAddr, _, err := f.newLeaf(newKey, value)
+		if err != nil {
+			return nullAddr, err
+		}
+		f.setZeroChild(an, newLeafAddr)
+		nodeAddr, _, err = f.setChild(nodeAddr, an, oldByte, oldLeafAddr)
+		return nodeAddr, err
+	case oldByte == newByte:
+		childAddr, err := f.insert(oldLeafAddr, newKey, depth+1, value)
+		if err != nil {
+			return nullAddr, err
+		}
+		nodeAddr, _, err = f.setChild(nodeAddr, an, oldByte, childAddr)
+		return nodeAddr, err
+	default:
+		nodeAddr, an, err = f.setChild(nodeAddr, an, oldByte, oldLeafAddr)
+		if err != nil {
+			return nullAddr, err
+		}
+		newLeafAddr, _, err := f.newLeaf(newKey, value)
+		if err != nil {
+			return nullAddr, err
+		}
+		nodeAddr, _, err = f.setChild(nodeAddr, an, newByte, newLeafAddr)
+		return nodeAddr, err
+	}
+}
@@ -0,0 +1,53 @@
+package art
+
+import "testing"
+
+// BenchmarkInsertDeleteStableCapacity repeatedly deletes and reinserts the
+// same key set. Capacity should stop growing once the freelists have enough
+// abandoned nodes in circulation - if newNodeN always fell back to alloc
+// this would climb forever instead.
+func BenchmarkInsertDeleteStableCapacity(b *testing.B) {
+	tr := newTree()
+	keys := make([]Key, 64)
+	for i := range keys {
+		keys[i] = Key{byte(i)}
+	}
+	for i, k := range keys {
+		if err := tr.Insert(k, i); err != nil {
+			b.Fatalf("warmup Insert: %v", err)
+		}
+	}
+
+	// Run a few full cycles before measuring, so the nodes each cycle frees
+	// and reallocates are already in circulation.
+	for cycle := 0; cycle < 4; cycle++ {
+		for _, k := range keys {
+			tr.Delete(k)
+		}
+		for i, k := range keys {
+			if err := tr.Insert(k, i); err != nil {
+				b.Fatalf("warmup cycle Insert: %v", err)
+			}
+		}
+	}
+	stable := tr.factory.Capacity()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// Deleting every key empties and frees the root; reinserting them
+		// rebuilds it through node4 -> node16 -> node48 -> node256.
+		for _, k := range keys {
+			tr.Delete(k)
+		}
+		for i, k := range keys {
+			if err := tr.Insert(k, i); err != nil {
+				b.Fatalf("Insert: %v", err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	if got := tr.factory.Capacity(); got > stable {
+		b.Fatalf("Capacity grew from %d to %d bytes across the insert/delete loop", stable, got)
+	}
+}